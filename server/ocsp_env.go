@@ -0,0 +1,105 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// OCSPEnv bundles the OCSP state — logging, the live status registry behind
+// /ocspz and the Prometheus series, and the peer verification cache — that
+// would otherwise have to live in package-level globals. nats-server
+// routinely runs more than one embedded *Server in a single process (its own
+// test suite does this constantly), so that state is scoped to an OCSPEnv
+// instead: each GenOCSPConfig caller either supplies its own (shared across
+// all of that server's listeners) via TLSConfigOpts.OCSPEnv, or gets a
+// private one created for it, and two unrelated servers — or two unrelated
+// tests linked into the same binary — can no longer cross-contaminate each
+// other's OCSP state, even when they happen to mint certificates with the
+// same serial number.
+type OCSPEnv struct {
+	log       OCSPLogger
+	status    *ocspStatusRegistry
+	peerCache *peerOCSPCache
+}
+
+// NewOCSPEnv returns a fresh, empty OCSPEnv logging through the standard
+// library's log package until SetLogger installs something else (typically
+// a *Server).
+func NewOCSPEnv() *OCSPEnv {
+	return &OCSPEnv{
+		log:       stdOCSPLogger{},
+		status:    &ocspStatusRegistry{entries: make(map[string]OCSPStatusEntry)},
+		peerCache: &peerOCSPCache{entries: make(map[string]peerOCSPCacheEntry)},
+	}
+}
+
+// SetLogger routes every OCSP log line (stapling, peer verification, source
+// fetches) produced within this env through l instead of the standard
+// library's log package. Passing nil restores that fallback.
+func (e *OCSPEnv) SetLogger(l OCSPLogger) {
+	if l == nil {
+		l = stdOCSPLogger{}
+	}
+	e.log = l
+}
+
+// SetStatusChangeHandler installs the callback invoked whenever a
+// certificate tracked in this env transitions between Good/Revoked/Unknown.
+// Passing nil disables notifications. This package has no SYSTEM account or
+// event subsystem of its own to publish through; a *Server embedding it is
+// expected to set this to a handler that publishes its own
+// "$SYS.SERVER.<id>.OCSP.STATUS_CHANGE"-shaped event, or whatever event
+// scheme it uses. Until that wiring lands, this is this package's sole
+// notification mechanism and is exercised directly by tests.
+func (e *OCSPEnv) SetStatusChangeHandler(h OCSPStatusChangeHandler) {
+	e.status.mu.Lock()
+	defer e.status.mu.Unlock()
+	e.status.onChange = h
+}
+
+// Statusz returns a snapshot of every certificate this env currently has
+// OCSP information about, for serving at /ocspz.
+func (e *OCSPEnv) Statusz() OCSPStatusz {
+	return e.status.snapshot()
+}
+
+// HandleOCSPz serves Statusz as JSON, for the existing monitoring port.
+func (e *OCSPEnv) HandleOCSPz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.Statusz())
+}
+
+// WritePrometheusMetrics writes nats_ocsp_* series in the Prometheus text
+// exposition format for every certificate and fetch counter tracked in this
+// env. It is meant to be appended to the server's existing /metrics output.
+func (e *OCSPEnv) WritePrometheusMetrics(w io.Writer) {
+	e.status.writePrometheusMetrics(w)
+}
+
+// RegisterMonitorz installs the /ocspz JSON status endpoint and an OCSP-only
+// /metrics endpoint on mux. This package has no monitoring port of its own;
+// a *Server would instead call HandleOCSPz/WritePrometheusMetrics directly
+// to fold this env's OCSP surface into its existing /varz, /connz, etc. mux
+// alongside its other endpoints. RegisterMonitorz is the standalone
+// equivalent for embedders (and tests) that just want this env's OCSP
+// surface served on its own.
+func (e *OCSPEnv) RegisterMonitorz(mux *http.ServeMux) {
+	mux.HandleFunc("/ocspz", e.HandleOCSPz)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		e.WritePrometheusMetrics(w)
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "log"
+
+// OCSPLogger is the slice of the server's own logger that the OCSP code
+// needs. It deliberately mirrors the Noticef/Warnf/Errorf methods the
+// server logger already exposes elsewhere in this codebase, so that
+// wiring a *Server in as an OCSPEnv's logger is a one-line
+// env.SetLogger(s) call rather than a rewrite.
+type OCSPLogger interface {
+	Noticef(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// stdOCSPLogger is the fallback used by a new OCSPEnv until a real server
+// logger is installed via SetLogger, e.g. when this package is exercised
+// standalone in tests.
+type stdOCSPLogger struct{}
+
+func (stdOCSPLogger) Noticef(format string, v ...interface{}) { log.Printf("[INF] "+format, v...) }
+func (stdOCSPLogger) Warnf(format string, v ...interface{})   { log.Printf("[WRN] "+format, v...) }
+func (stdOCSPLogger) Errorf(format string, v ...interface{})  { log.Printf("[ERR] "+format, v...) }
@@ -0,0 +1,173 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// peerOCSPCacheEntry is one validated response held in the in-memory peer
+// cache, indexed by certificate serial.
+type peerOCSPCacheEntry struct {
+	status     int
+	nextUpdate time.Time
+}
+
+// peerOCSPCache is a small in-memory cache of peer certificate OCSP
+// statuses shared across every route, gateway, leafnode and cluster
+// connection the server makes, keyed by the peer leaf's serial number and
+// valid until the response's NextUpdate.
+type peerOCSPCache struct {
+	mu      sync.Mutex
+	entries map[string]peerOCSPCacheEntry
+}
+
+func (c *peerOCSPCache) get(serial string) (peerOCSPCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[serial]
+	if ok && time.Now().After(e.nextUpdate) {
+		delete(c.entries, serial)
+		return peerOCSPCacheEntry{}, false
+	}
+	return e, ok
+}
+
+func (c *peerOCSPCache) put(serial string, e peerOCSPCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[serial] = e
+}
+
+// OCSPPeerVerifier returns a tls.Config.VerifyConnection callback that
+// performs OCSP revocation checking of the peer's leaf certificate. It is
+// installed by GenOCSPConfig on every tls.Config it produces, which in turn
+// is the tls.Config used for outbound and inbound route, gateway, leafnode
+// and cluster connections — so mTLS is symmetric: both sides
+// revocation-check the other, not just the server's own cert.
+//
+// If the peer stapled a response (tls.ConnectionState.OCSPResponse), that
+// is used directly. Otherwise, when mode >= OCSPModeAuto, the responder
+// named in the peer's certificate is queried directly, unless overrideURLs
+// is non-empty, in which case those URLs are tried instead (mirroring
+// TLSConfigOpts.OCSPServerOverride for the server's own stapling). Under
+// OCSPModeAlwaysMust the connection is dropped if the resulting status is
+// anything other than ocsp.Good. Logging, the peer cache and the /ocspz
+// status registry are all scoped to env, the same OCSPEnv GenOCSPConfig
+// used to build the tls.Config this verifier is installed on.
+func OCSPPeerVerifier(mode OCSPMode, overrideURLs []string, env *OCSPEnv) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if mode == OCSPModeNever || len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		leaf := cs.PeerCertificates[0]
+		var issuer *x509.Certificate
+		if len(cs.PeerCertificates) > 1 {
+			issuer = cs.PeerCertificates[1]
+		}
+
+		serial := serialHex(leaf)
+
+		raw := cs.OCSPResponse
+		responderURL := ""
+		if len(raw) == 0 {
+			if mode < OCSPModeAuto {
+				return nil
+			}
+			urls := overrideURLs
+			if len(urls) == 0 {
+				urls = leaf.OCSPServer
+			}
+			if len(urls) == 0 || issuer == nil {
+				return nil
+			}
+			if entry, ok := env.peerCache.get(serial); ok {
+				return statusToErr(mode, leaf, entry.status, env)
+			}
+			var err error
+			for _, url := range urls {
+				raw, err = fetchOCSPResponse(leaf, issuer, url)
+				if err == nil {
+					responderURL = url
+					break
+				}
+			}
+			if err != nil {
+				env.log.Warnf("OCSP: unable to verify peer cert %s: %s", describePeer(leaf), err)
+				if mode == OCSPModeAlwaysMust {
+					return fmt.Errorf("ocsp: unable to verify peer certificate %s: %w", describePeer(leaf), err)
+				}
+				return nil
+			}
+		}
+
+		if issuer == nil {
+			// Without an issuer we cannot validate the response signature;
+			// treat as unverifiable rather than silently trusting it.
+			if mode == OCSPModeAlwaysMust {
+				return fmt.Errorf("ocsp: cannot verify peer certificate %s: issuer unknown", describePeer(leaf))
+			}
+			return nil
+		}
+
+		resp, err := ocsp.ParseResponse(raw, issuer)
+		if err != nil {
+			if mode == OCSPModeAlwaysMust {
+				return fmt.Errorf("ocsp: invalid OCSP response for peer %s: %w", describePeer(leaf), err)
+			}
+			return nil
+		}
+
+		env.peerCache.put(serial, peerOCSPCacheEntry{status: resp.Status, nextUpdate: resp.NextUpdate})
+		if responderURL == "" && len(leaf.OCSPServer) > 0 {
+			responderURL = leaf.OCSPServer[0]
+		}
+		env.status.record(serial, certName(leaf), certName(issuer), ocspSourcePeer, responderURL, resp, nil)
+		return statusToErr(mode, leaf, resp.Status, env)
+	}
+}
+
+func statusToErr(mode OCSPMode, leaf *x509.Certificate, status int, env *OCSPEnv) error {
+	switch status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		env.log.Errorf("OCSP: dropping connection to peer %s: certificate revoked", describePeer(leaf))
+		return fmt.Errorf("ocsp: peer certificate %s is revoked", describePeer(leaf))
+	default: // ocsp.Unknown
+		if mode == OCSPModeAlwaysMust {
+			env.log.Warnf("OCSP: dropping connection to peer %s: certificate status unknown", describePeer(leaf))
+			return fmt.Errorf("ocsp: peer certificate %s has unknown OCSP status", describePeer(leaf))
+		}
+		return nil
+	}
+}
+
+func describePeer(leaf *x509.Certificate) string {
+	return distinguishedName(leaf.Subject)
+}
+
+func distinguishedName(name pkix.Name) string {
+	if cn := name.CommonName; cn != "" {
+		return cn
+	}
+	return name.String()
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPSource abstracts where a server obtains the stapled OCSP response for
+// one of its own certificates. The built-in behavior (HTTPSource) fetches
+// from the responder named in the certificate, but operators can configure
+// FileSource or DirSource instead, or register their own via
+// RegisterOCSPSource.
+type OCSPSource interface {
+	// Response returns the raw DER OCSP response for the certificate with
+	// the given serial number, or an error if none is available.
+	Response(ctx context.Context, serial *big.Int) ([]byte, error)
+}
+
+// OCSPSourceDescriber is an optional interface an OCSPSource can implement to
+// report the responder URL or location its last response came from, shown in
+// the /ocspz status entry's ResponderURL field. OCSPMonitor.refresh falls
+// back to "" for sources that don't implement it.
+type OCSPSourceDescriber interface {
+	Describe() string
+}
+
+// ocspSourceCtor builds an OCSPSource from the raw JSON body of an
+// `ocsp { source: "<name>", ... }` config block.
+type ocspSourceCtor func(json.RawMessage) (OCSPSource, error)
+
+var (
+	ocspSourceRegistryMu sync.Mutex
+	ocspSourceRegistry   = map[string]ocspSourceCtor{
+		"http": func(raw json.RawMessage) (OCSPSource, error) {
+			var cfg struct {
+				OverrideURLs []string `json:"override_urls"`
+			}
+			if len(raw) > 0 {
+				if err := json.Unmarshal(raw, &cfg); err != nil {
+					return nil, err
+				}
+			}
+			return &HTTPSource{OverrideURLs: cfg.OverrideURLs}, nil
+		},
+		"file": func(raw json.RawMessage) (OCSPSource, error) {
+			var cfg struct {
+				Path string `json:"path"`
+			}
+			if err := json.Unmarshal(raw, &cfg); err != nil {
+				return nil, err
+			}
+			return NewFileSource(cfg.Path)
+		},
+		"dir": func(raw json.RawMessage) (OCSPSource, error) {
+			var cfg struct {
+				Path string `json:"path"`
+			}
+			if err := json.Unmarshal(raw, &cfg); err != nil {
+				return nil, err
+			}
+			return NewDirSource(cfg.Path), nil
+		},
+	}
+)
+
+// RegisterOCSPSource makes a new `ocsp { source: "<name>" }` value available,
+// so third parties can plug in backends (S3, Redis, etc.) without forking
+// the server. Re-registering an existing name overwrites it.
+func RegisterOCSPSource(name string, ctor func(json.RawMessage) (OCSPSource, error)) {
+	ocspSourceRegistryMu.Lock()
+	defer ocspSourceRegistryMu.Unlock()
+	ocspSourceRegistry[name] = ctor
+}
+
+// newOCSPSource looks up a registered source by name and constructs it from
+// the config block's raw JSON body.
+func newOCSPSource(name string, raw json.RawMessage) (OCSPSource, error) {
+	ocspSourceRegistryMu.Lock()
+	ctor, ok := ocspSourceRegistry[name]
+	ocspSourceRegistryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("ocsp: unknown source %q", name)
+	}
+	return ctor(raw)
+}
+
+// HTTPSource is the default OCSPSource: it fetches a response from the
+// responder(s) named in the certificate's Authority Information Access
+// extension, or from OverrideURLs if set. This is the behavior GenOCSPConfig
+// has always used; it is now expressed as an OCSPSource so it can be swapped
+// out.
+type HTTPSource struct {
+	OverrideURLs []string
+
+	// Leaf and Issuer must be set (by GenOCSPConfig) before Response is
+	// called, since the OCSP request itself is keyed off both.
+	Leaf   *x509.Certificate
+	Issuer *x509.Certificate
+
+	mu      sync.Mutex
+	lastURL string
+}
+
+func (s *HTTPSource) Response(_ context.Context, serial *big.Int) ([]byte, error) {
+	if s.Leaf == nil || s.Issuer == nil {
+		return nil, fmt.Errorf("ocsp: HTTPSource used before Leaf/Issuer were set")
+	}
+	if s.Leaf.SerialNumber.Cmp(serial) != 0 {
+		return nil, fmt.Errorf("ocsp: HTTPSource is scoped to serial %s, asked for %s", s.Leaf.SerialNumber, serial)
+	}
+
+	urls := s.OverrideURLs
+	if len(urls) == 0 {
+		urls = s.Leaf.OCSPServer
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("ocsp: no responder URL for certificate serial %s", serial)
+	}
+
+	var lastErr error
+	for _, url := range urls {
+		raw, err := fetchOCSPResponse(s.Leaf, s.Issuer, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.mu.Lock()
+		s.lastURL = url
+		s.mu.Unlock()
+		return raw, nil
+	}
+	return nil, lastErr
+}
+
+// Describe returns the responder URL the most recent successful Response
+// call used, for the /ocspz status entry's ResponderURL field.
+func (s *HTTPSource) Describe() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastURL
+}
+
+// FileSource serves stapled responses purely from a local file containing
+// whitespace-separated base64-DER OCSP responses, with no network I/O. It
+// is intended for air-gapped clusters or setups where staples are pushed by
+// an external tool (e.g. a CDN). The file is read by NewFileSource and
+// re-read whenever Reload is called; nothing in this package calls Reload on
+// SIGHUP.
+type FileSource struct {
+	path string
+
+	mu       sync.RWMutex
+	bySerial map[string][]byte
+}
+
+// NewFileSource reads and indexes path, keyed by each response's
+// SerialNumber.
+func NewFileSource(path string) (*FileSource, error) {
+	s := &FileSource{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the backing file, replacing the in-memory index. Called
+// by NewFileSource; later calls are up to the embedder.
+func (s *FileSource) Reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("ocsp: unable to read file source %s: %w", s.path, err)
+	}
+
+	index := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		tok := strings.TrimSpace(scanner.Text())
+		if tok == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(tok)
+		if err != nil {
+			return fmt.Errorf("ocsp: invalid base64 DER response in %s: %w", s.path, err)
+		}
+		resp, err := ocsp.ParseResponse(raw, nil)
+		if err != nil {
+			return fmt.Errorf("ocsp: invalid OCSP response in %s: %w", s.path, err)
+		}
+		index[resp.SerialNumber.String()] = raw
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.bySerial = index
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *FileSource) Response(_ context.Context, serial *big.Int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	raw, ok := s.bySerial[serial.String()]
+	if !ok {
+		return nil, fmt.Errorf("ocsp: no response for serial %s in %s", serial, s.path)
+	}
+	return raw, nil
+}
+
+// Describe returns the backing file's path, for the /ocspz status entry's
+// ResponderURL field.
+func (s *FileSource) Describe() string {
+	return "file:" + s.path
+}
+
+// DirSource watches a directory (typically OCSPStatusDir) for <serial>.ocsp
+// files written by an external tool, and serves their contents directly.
+// Unlike FileSource it does no up-front indexing: each Response call reads
+// straight from disk, so new or updated files are picked up automatically.
+type DirSource struct {
+	dir string
+}
+
+// NewDirSource returns a DirSource reading responses from dir.
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{dir: dir}
+}
+
+func (s *DirSource) Response(_ context.Context, serial *big.Int) ([]byte, error) {
+	path := filepath.Join(s.dir, serial.String()+".ocsp")
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ocsp: no staple found at %s: %w", path, err)
+	}
+	return raw, nil
+}
+
+// Describe returns the backing directory, for the /ocspz status entry's
+// ResponderURL field.
+func (s *DirSource) Describe() string {
+	return "dir:" + s.dir
+}
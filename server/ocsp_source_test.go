@@ -0,0 +1,128 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// genTestOCSPResponse builds a self-signed CA and a Good OCSP response for
+// serial, returning the raw DER response bytes.
+func genTestOCSPResponse(t *testing.T, serial *big.Int) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ocsp-source-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   time.Now(),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	raw, err := ocsp.CreateResponse(ca, ca, resp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestFileSourceReload(t *testing.T) {
+	serial := big.NewInt(42)
+	raw := genTestOCSPResponse(t, serial)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "staples.txt")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(raw)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewFileSource(path)
+	if err != nil {
+		t.Fatalf("NewFileSource failed: %s", err)
+	}
+
+	if _, err := src.Response(context.Background(), serial); err != nil {
+		t.Fatalf("expected a response for serial %s, got error: %s", serial, err)
+	}
+	if _, err := src.Response(context.Background(), big.NewInt(99)); err == nil {
+		t.Fatal("expected an error for an unindexed serial")
+	}
+
+	// Reload should pick up a file that now has nothing for the serial.
+	if err := os.WriteFile(path, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	if _, err := src.Response(context.Background(), serial); err == nil {
+		t.Fatal("expected an error after Reload dropped the serial's entry")
+	}
+}
+
+func TestDirSourceResponse(t *testing.T) {
+	serial := big.NewInt(7)
+	raw := genTestOCSPResponse(t, serial)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, serial.String()+".ocsp")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewDirSource(dir)
+	got, err := src.Response(context.Background(), serial)
+	if err != nil {
+		t.Fatalf("Response failed: %s", err)
+	}
+	if string(got) != string(raw) {
+		t.Fatal("expected DirSource to return the exact bytes on disk")
+	}
+
+	if _, err := src.Response(context.Background(), big.NewInt(404)); err == nil {
+		t.Fatal("expected an error for a serial with no staple file")
+	}
+}
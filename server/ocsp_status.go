@@ -0,0 +1,214 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPStatusEntry is one certificate's tracked OCSP state, as surfaced by
+// the /ocspz monitoring endpoint.
+type OCSPStatusEntry struct {
+	Subject        string    `json:"subject"`
+	Issuer         string    `json:"issuer"`
+	Status         string    `json:"status"`
+	ThisUpdate     time.Time `json:"this_update,omitempty"`
+	NextUpdate     time.Time `json:"next_update,omitempty"`
+	LastFetchError string    `json:"last_fetch_error,omitempty"`
+	ResponderURL   string    `json:"responder_url,omitempty"`
+	Source         string    `json:"source"`
+}
+
+// OCSPStatusz is the payload served at /ocspz: every certificate (the
+// server's own, plus any peers it has verified) the process currently has
+// OCSP information about, keyed by serial number.
+type OCSPStatusz struct {
+	Entries map[string]OCSPStatusEntry `json:"entries"`
+}
+
+// ocspSourceServer and ocspSourcePeer identify where a status entry's data
+// originated, used in the JSON payload's source field.
+const (
+	ocspSourceServer = "server"
+	ocspSourcePeer   = "peer"
+)
+
+// ocspFetchCounters counts recorded OCSP fetches by result ("success" or
+// "error"), for the nats_ocsp_fetch_total Prometheus series.
+type ocspFetchCounters struct {
+	mu       sync.Mutex
+	byResult map[string]uint64
+}
+
+func (c *ocspFetchCounters) inc(result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byResult == nil {
+		c.byResult = make(map[string]uint64)
+	}
+	c.byResult[result]++
+}
+
+func (c *ocspFetchCounters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.byResult))
+	for k, v := range c.byResult {
+		out[k] = v
+	}
+	return out
+}
+
+// ocspStatusRegistry is the table backing one OCSPEnv's /ocspz and
+// Prometheus gauges. It is updated by OCSPMonitor.refresh for the server's
+// own certificates and by OCSPPeerVerifier for peer certificates.
+type ocspStatusRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]OCSPStatusEntry // keyed by serial, hex
+
+	fetches  ocspFetchCounters
+	onChange OCSPStatusChangeHandler
+}
+
+// OCSPStatusChangeEvent describes a single Good/Revoked/Unknown transition
+// for a tracked certificate serial.
+type OCSPStatusChangeEvent struct {
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Source    string    `json:"source"`
+	OldStatus string    `json:"old_status,omitempty"`
+	NewStatus string    `json:"new_status"`
+	Time      time.Time `json:"time"`
+}
+
+// OCSPStatusChangeHandler is invoked whenever a tracked certificate
+// transitions between Good/Revoked/Unknown, installed via
+// OCSPEnv.SetStatusChangeHandler. A server embedding this package would wire
+// this to publishing its own SYSTEM account event (no such event exists in
+// this package, which has no account/events subsystem of its own); tests and
+// standalone uses may set it to observe transitions directly.
+type OCSPStatusChangeHandler func(OCSPStatusChangeEvent)
+
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// record updates the registry for serial, bumps the fetch counter for the
+// call's result, and, if the status differs from what was previously known,
+// fires the change handler.
+func (reg *ocspStatusRegistry) record(serial, subject, issuer, source, responderURL string, resp *ocsp.Response, fetchErr error) {
+	reg.mu.Lock()
+
+	entry := reg.entries[serial]
+	oldStatus := entry.Status
+
+	entry.Subject = subject
+	entry.Issuer = issuer
+	entry.Source = source
+	entry.ResponderURL = responderURL
+	if fetchErr != nil {
+		entry.LastFetchError = fetchErr.Error()
+	} else {
+		entry.LastFetchError = ""
+	}
+	if resp != nil {
+		entry.Status = ocspStatusString(resp.Status)
+		entry.ThisUpdate = resp.ThisUpdate
+		entry.NextUpdate = resp.NextUpdate
+	}
+	reg.entries[serial] = entry
+	handler := reg.onChange
+	reg.mu.Unlock()
+
+	result := "success"
+	if fetchErr != nil {
+		result = "error"
+	}
+	reg.fetches.inc(result)
+
+	if resp == nil || handler == nil || entry.Status == oldStatus {
+		return
+	}
+	handler(OCSPStatusChangeEvent{
+		Serial:    serial,
+		Subject:   subject,
+		Source:    source,
+		OldStatus: oldStatus,
+		NewStatus: entry.Status,
+		Time:      time.Now(),
+	})
+}
+
+// snapshot returns a point-in-time copy of every tracked certificate's OCSP
+// status, for serving at /ocspz.
+func (reg *ocspStatusRegistry) snapshot() OCSPStatusz {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	snap := make(map[string]OCSPStatusEntry, len(reg.entries))
+	for k, v := range reg.entries {
+		snap[k] = v
+	}
+	return OCSPStatusz{Entries: snap}
+}
+
+// writePrometheusMetrics writes nats_ocsp_* series in the Prometheus text
+// exposition format for every tracked certificate and fetch counter.
+func (reg *ocspStatusRegistry) writePrometheusMetrics(w io.Writer) {
+	reg.mu.RLock()
+	entries := make(map[string]OCSPStatusEntry, len(reg.entries))
+	for k, v := range reg.entries {
+		entries[k] = v
+	}
+	reg.mu.RUnlock()
+
+	fmt.Fprintln(w, "# HELP nats_ocsp_fetch_total Total OCSP fetch attempts, by result.")
+	fmt.Fprintln(w, "# TYPE nats_ocsp_fetch_total counter")
+	for result, n := range reg.fetches.snapshot() {
+		fmt.Fprintf(w, "nats_ocsp_fetch_total{result=%q} %d\n", result, n)
+	}
+
+	fmt.Fprintln(w, "# HELP nats_ocsp_staple_expiry_seconds Seconds until the tracked staple's NextUpdate.")
+	fmt.Fprintln(w, "# TYPE nats_ocsp_staple_expiry_seconds gauge")
+	fmt.Fprintln(w, "# HELP nats_ocsp_revoked Whether a tracked certificate is currently revoked (1) or not (0).")
+	fmt.Fprintln(w, "# TYPE nats_ocsp_revoked gauge")
+	for serial, e := range entries {
+		if !e.NextUpdate.IsZero() {
+			fmt.Fprintf(w, "nats_ocsp_staple_expiry_seconds{serial=%q} %.0f\n", serial, time.Until(e.NextUpdate).Seconds())
+		}
+		revoked := 0
+		if e.Status == "revoked" {
+			revoked = 1
+		}
+		fmt.Fprintf(w, "nats_ocsp_revoked{serial=%q} %d\n", serial, revoked)
+	}
+}
+
+// certName renders a certificate's subject for use in status entries,
+// falling back to the full distinguished name when there is no CN.
+func certName(cert *x509.Certificate) string {
+	return distinguishedName(cert.Subject)
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRegisterOCSPMonitorz(t *testing.T) {
+	env := NewOCSPEnv()
+	env.status.record("deadbeef", "monitorz-test", "monitorz-test-ca", ocspSourceServer, "http://responder.example",
+		&ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, nil)
+
+	mux := http.NewServeMux()
+	env.RegisterMonitorz(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ocspz")
+	if err != nil {
+		t.Fatalf("GET /ocspz failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /ocspz, got %s", resp.Status)
+	}
+	var status OCSPStatusz
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode /ocspz response: %s", err)
+	}
+	entry, ok := status.Entries["deadbeef"]
+	if !ok {
+		t.Fatal("expected /ocspz to include the recorded serial \"deadbeef\"")
+	}
+	if entry.Status != "good" {
+		t.Fatalf("expected status \"good\", got %q", entry.Status)
+	}
+
+	metricsResp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %s", err)
+	}
+	defer metricsResp.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(metricsResp.Body)
+	if !strings.Contains(buf.String(), `nats_ocsp_revoked{serial="deadbeef"} 0`) {
+		t.Fatalf("expected /metrics to include a nats_ocsp_revoked series for \"deadbeef\", got:\n%s", buf.String())
+	}
+}
+
+func TestOCSPStatusChangeHandler(t *testing.T) {
+	env := NewOCSPEnv()
+	var got []OCSPStatusChangeEvent
+	env.SetStatusChangeHandler(func(e OCSPStatusChangeEvent) { got = append(got, e) })
+
+	const serial = "cafef00d"
+	env.status.record(serial, "status-change-test", "status-change-test-ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, nil)
+	env.status.record(serial, "status-change-test", "status-change-test-ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, nil)
+	env.status.record(serial, "status-change-test", "status-change-test-ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Revoked, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, nil)
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 transitions (\"\"->good, good->revoked), got %d: %+v", len(got), got)
+	}
+	if got[0].OldStatus != "" || got[0].NewStatus != "good" {
+		t.Fatalf("expected first transition \"\"->good, got %q->%q", got[0].OldStatus, got[0].NewStatus)
+	}
+	if got[1].OldStatus != "good" || got[1].NewStatus != "revoked" {
+		t.Fatalf("expected second transition good->revoked, got %q->%q", got[1].OldStatus, got[1].NewStatus)
+	}
+}
+
+func TestWriteOCSPPrometheusMetrics(t *testing.T) {
+	env := NewOCSPEnv()
+	env.status.record("f00dcafe", "metrics-test", "metrics-test-ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Revoked, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, nil)
+
+	var buf bytes.Buffer
+	env.WritePrometheusMetrics(&buf)
+	out := buf.String()
+
+	if !strings.Contains(out, "nats_ocsp_fetch_total{result=\"success\"}") {
+		t.Fatalf("expected a nats_ocsp_fetch_total success series, got:\n%s", out)
+	}
+	if !strings.Contains(out, `nats_ocsp_revoked{serial="f00dcafe"} 1`) {
+		t.Fatalf("expected nats_ocsp_revoked=1 for the revoked serial, got:\n%s", out)
+	}
+}
+
+func TestOCSPEnvIsolation(t *testing.T) {
+	a, b := NewOCSPEnv(), NewOCSPEnv()
+	a.status.record("1", "server-a", "ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Good, NextUpdate: time.Now().Add(time.Hour)}, nil)
+	b.status.record("1", "server-b", "ca", ocspSourceServer, "",
+		&ocsp.Response{Status: ocsp.Revoked, NextUpdate: time.Now().Add(time.Hour)}, nil)
+
+	if entry := a.Statusz().Entries["1"]; entry.Status != "good" {
+		t.Fatalf("expected env a's serial \"1\" to remain \"good\", got %q", entry.Status)
+	}
+	if entry := b.Statusz().Entries["1"]; entry.Status != "revoked" {
+		t.Fatalf("expected env b's serial \"1\" to be \"revoked\", got %q", entry.Status)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestCertRequiresMustStaple(t *testing.T) {
+	withExt := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "must-staple"},
+		Extensions: []pkix.Extension{
+			{Id: idPeTLSFeature, Value: tlsFeatureMustStaple},
+		},
+	}
+	if !certRequiresMustStaple(withExt) {
+		t.Fatal("expected certificate with id-pe-tlsfeature Must-Staple extension to be detected")
+	}
+
+	withoutExt := &x509.Certificate{Subject: pkix.Name{CommonName: "plain"}}
+	if certRequiresMustStaple(withoutExt) {
+		t.Fatal("expected certificate with no extensions to not require Must-Staple")
+	}
+
+	wrongValue := &x509.Certificate{
+		Extensions: []pkix.Extension{
+			{Id: idPeTLSFeature, Value: []byte{0x30, 0x03, 0x02, 0x01, 0x02}}, // feature 2, not status_request (5)
+		},
+	}
+	if certRequiresMustStaple(wrongValue) {
+		t.Fatal("expected a TLSFeature extension not encoding status_request to not count as Must-Staple")
+	}
+}
+
+func TestComputeNextWait(t *testing.T) {
+	minWait := 2 * time.Second
+
+	if got := computeNextWait(minWait, time.Time{}); got != minWait {
+		t.Fatalf("with no NextUpdate, expected floor %s, got %s", minWait, got)
+	}
+
+	// NextUpdate far in the future: wait should land under it (minus jitter)
+	// and never fall below minWait.
+	future := time.Now().Add(time.Hour)
+	if got := computeNextWait(minWait, future); got < minWait || got > time.Hour {
+		t.Fatalf("expected wait in [%s, 1h], got %s", minWait, got)
+	}
+
+	// NextUpdate already in the past: must clamp to minWait, not go negative.
+	past := time.Now().Add(-time.Hour)
+	if got := computeNextWait(minWait, past); got != minWait {
+		t.Fatalf("expected floor %s for an expired NextUpdate, got %s", minWait, got)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	minWait := time.Second
+
+	if got := nextBackoff(0, minWait); got != minWait {
+		t.Fatalf("expected first backoff to equal MinWait %s, got %s", minWait, got)
+	}
+
+	cur := minWait
+	for i := 0; i < 10; i++ {
+		cur = nextBackoff(cur, minWait)
+	}
+	if cur != ocspMaxBackoff {
+		t.Fatalf("expected backoff to saturate at %s, got %s", ocspMaxBackoff, cur)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocspresponder
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// indexEntry is one revocation record parsed out of an OpenSSL-style
+// index.txt certificate database.
+type indexEntry struct {
+	// state is one of 'V' (valid), 'R' (revoked) or 'E' (expired).
+	state byte
+
+	revocationTime time.Time
+	serial         *big.Int
+	subject        string
+}
+
+// indexTimeLayout is the timestamp format OpenSSL's ca tool writes into
+// index.txt: YYMMDDHHMMSSZ.
+const indexTimeLayout = "060102150405Z"
+
+// parseIndex reads an OpenSSL `index.txt` certificate database and returns
+// its entries keyed by keyForSerial(serial) (lowercase hex of the serial's
+// minimal big-endian bytes, so leading zero bytes are dropped).
+//
+// Each line has the form:
+//
+//	V<TAB>expiry<TAB><TAB>serial<TAB>filename<TAB>subject
+//	R<TAB>expiry<TAB>revocationTime<TAB>serial<TAB>filename<TAB>subject
+//	E<TAB>expiry<TAB><TAB>serial<TAB>filename<TAB>subject
+func parseIndex(path string) (map[string]indexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ocspresponder: unable to open certificate list %s: %w", path, err)
+	}
+	defer f.Close()
+
+	entries := make(map[string]indexEntry)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("ocspresponder: %s:%d: expected 6 tab-separated fields, got %d", path, lineNo, len(fields))
+		}
+
+		state := fields[0]
+		if len(state) != 1 {
+			return nil, fmt.Errorf("ocspresponder: %s:%d: invalid state %q", path, lineNo, state)
+		}
+
+		serial, ok := new(big.Int).SetString(fields[3], 16)
+		if !ok {
+			return nil, fmt.Errorf("ocspresponder: %s:%d: invalid serial %q", path, lineNo, fields[3])
+		}
+
+		e := indexEntry{
+			state:   state[0],
+			serial:  serial,
+			subject: fields[5],
+		}
+		if state[0] == 'R' && fields[2] != "" {
+			// OpenSSL sometimes appends ",reason" after the timestamp.
+			ts := strings.SplitN(fields[2], ",", 2)[0]
+			t, err := time.Parse(indexTimeLayout, ts)
+			if err != nil {
+				return nil, fmt.Errorf("ocspresponder: %s:%d: invalid revocation time %q: %w", path, lineNo, fields[2], err)
+			}
+			e.revocationTime = t
+		}
+
+		entries[keyForSerial(serial)] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// keyForSerial normalizes a serial number to the map key used by both the
+// index parser and the responder lookup path.
+func keyForSerial(serial *big.Int) string {
+	return hex.EncodeToString(serial.Bytes())
+}
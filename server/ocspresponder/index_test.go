@@ -0,0 +1,111 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocspresponder
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeIndex(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.txt")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseIndexStates(t *testing.T) {
+	path := writeIndex(t, ""+
+		"V\t991231235959Z\t\t01\tunknown\t/CN=good\n"+
+		"R\t991231235959Z\t230102030405Z\t02\tunknown\t/CN=revoked\n"+
+		"E\t991231235959Z\t\t03\tunknown\t/CN=expired\n")
+
+	entries, err := parseIndex(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	good, ok := entries[keyForSerial(bigIntFromHex(t, "01"))]
+	if !ok || good.state != 'V' {
+		t.Fatalf("expected serial 01 to be state 'V', got %+v (ok=%v)", good, ok)
+	}
+
+	revoked, ok := entries[keyForSerial(bigIntFromHex(t, "02"))]
+	if !ok || revoked.state != 'R' {
+		t.Fatalf("expected serial 02 to be state 'R', got %+v (ok=%v)", revoked, ok)
+	}
+	if revoked.revocationTime.IsZero() {
+		t.Fatal("expected a parsed revocation time for the 'R' entry")
+	}
+
+	expired, ok := entries[keyForSerial(bigIntFromHex(t, "03"))]
+	if !ok || expired.state != 'E' {
+		t.Fatalf("expected serial 03 to be state 'E', got %+v (ok=%v)", expired, ok)
+	}
+	if !expired.revocationTime.IsZero() {
+		t.Fatal("expected no revocation time for an 'E' entry")
+	}
+}
+
+func TestParseIndexRevokedWithReason(t *testing.T) {
+	path := writeIndex(t, "R\t991231235959Z\t230102030405Z,keyCompromise\t04\tunknown\t/CN=revoked\n")
+
+	entries, err := parseIndex(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	e, ok := entries[keyForSerial(bigIntFromHex(t, "04"))]
+	if !ok {
+		t.Fatal("expected an entry for serial 04")
+	}
+	if e.revocationTime.IsZero() {
+		t.Fatal("expected the revocation time to be parsed even with a trailing reason")
+	}
+}
+
+func TestParseIndexMalformedLine(t *testing.T) {
+	path := writeIndex(t, "V\t991231235959Z\t\t01\tunknown\n") // missing subject field
+	if _, err := parseIndex(path); err == nil {
+		t.Fatal("expected an error for a line with too few fields")
+	}
+}
+
+func TestParseIndexBadSerial(t *testing.T) {
+	path := writeIndex(t, "V\t991231235959Z\t\tnotahex\tunknown\t/CN=bad\n")
+	if _, err := parseIndex(path); err == nil {
+		t.Fatal("expected an error for an unparseable serial")
+	}
+}
+
+func TestParseIndexMissingFile(t *testing.T) {
+	if _, err := parseIndex(filepath.Join(t.TempDir(), "does-not-exist.txt")); err == nil {
+		t.Fatal("expected an error opening a nonexistent index file")
+	}
+}
+
+func bigIntFromHex(t *testing.T, s string) *big.Int {
+	t.Helper()
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex serial %q", s)
+	}
+	return n
+}
@@ -0,0 +1,395 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocspresponder implements a minimal, multi-issuer OCSP responder
+// that a NATS operator can run alongside a cluster to serve OCSP for their
+// own PKI, mirroring the multi-issuer design of the cacert-goocsp project.
+// It is deliberately independent of the server package's client-side OCSP
+// code in server/ocsp.go: one staples/verifies, the other signs responses.
+package ocspresponder
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// IssuerConfig describes one CA this responder signs OCSP responses for.
+type IssuerConfig struct {
+	// CACertificate is the PEM file of the issuing CA certificate, used to
+	// match incoming requests by IssuerKeyHash.
+	CACertificate string
+
+	// ResponderCertificate and ResponderKey are the PEM files for the
+	// delegated (or CA-identical) OCSP signer.
+	ResponderCertificate string
+	ResponderKey         string
+
+	// CertificateList is an OpenSSL `ca` style index.txt database of
+	// issued certificates and their revocation state.
+	CertificateList string
+}
+
+// Config configures the embedded responder.
+type Config struct {
+	Issuers []IssuerConfig
+
+	// Addr is the listen address for the OCSP HTTP endpoint, e.g. ":8888".
+	Addr string
+
+	// ValidityWindow is how long a produced response is valid for
+	// (NextUpdate = ThisUpdate + ValidityWindow). Defaults to 1 hour.
+	ValidityWindow time.Duration
+
+	// ReloadInterval controls how often CertificateList files are checked
+	// for changes. Defaults to 30s.
+	ReloadInterval time.Duration
+
+	// Logger receives reload notifications and errors. Defaults to a
+	// logger that writes through the standard library's log package, for
+	// operators who run this responder standalone rather than embedded in
+	// a process with its own logging.
+	Logger Logger
+}
+
+// Logger is the slice of logging this package needs. Embedding processes
+// with their own logger (e.g. a *server.Server) satisfy this with
+// Noticef/Errorf and pass it in via Config.Logger instead of output going
+// to the standard library's log package.
+type Logger interface {
+	Noticef(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// stdLogger is the fallback used when Config.Logger is unset.
+type stdLogger struct{}
+
+func (stdLogger) Noticef(format string, v ...interface{}) { log.Printf("[INF] "+format, v...) }
+func (stdLogger) Errorf(format string, v ...interface{})  { log.Printf("[ERR] "+format, v...) }
+
+// issuer is the parsed, in-memory form of an IssuerConfig.
+type issuer struct {
+	cert          *x509.Certificate
+	responderCert *x509.Certificate
+	responderKey  crypto.Signer
+	keyHash       []byte
+
+	listPath    string
+	listModTime time.Time
+
+	mu      sync.RWMutex
+	entries map[string]indexEntry
+}
+
+// Responder is an embedded, multi-issuer OCSP responder.
+type Responder struct {
+	cfg     Config
+	log     Logger
+	issuers map[string]*issuer // keyed by hex(issuerKeyHash)
+
+	srv      *http.Server
+	ln       net.Listener
+	shutdown chan struct{}
+}
+
+// New loads every configured issuer and returns a Responder ready to
+// ListenAndServe. It does not start the HTTP listener.
+func New(cfg Config) (*Responder, error) {
+	if cfg.ValidityWindow == 0 {
+		cfg.ValidityWindow = time.Hour
+	}
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = 30 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = stdLogger{}
+	}
+
+	r := &Responder{
+		cfg:      cfg,
+		log:      cfg.Logger,
+		issuers:  make(map[string]*issuer),
+		shutdown: make(chan struct{}),
+	}
+
+	for _, ic := range cfg.Issuers {
+		iss, err := loadIssuer(ic)
+		if err != nil {
+			return nil, err
+		}
+		r.issuers[hex.EncodeToString(iss.keyHash)] = iss
+	}
+
+	return r, nil
+}
+
+func loadIssuer(ic IssuerConfig) (*issuer, error) {
+	caCert, err := readCertPEM(ic.CACertificate)
+	if err != nil {
+		return nil, fmt.Errorf("ocspresponder: loading CA certificate: %w", err)
+	}
+	responderCert, err := readCertPEM(ic.ResponderCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("ocspresponder: loading responder certificate: %w", err)
+	}
+	pair, err := tls.LoadX509KeyPair(ic.ResponderCertificate, ic.ResponderKey)
+	if err != nil {
+		return nil, fmt.Errorf("ocspresponder: loading responder key: %w", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("ocspresponder: responder key for %s is not a crypto.Signer", ic.ResponderCertificate)
+	}
+
+	iss := &issuer{
+		cert:          caCert,
+		responderCert: responderCert,
+		responderKey:  signer,
+		keyHash:       issuerKeyHash(caCert),
+		listPath:      ic.CertificateList,
+	}
+	if err := iss.reload(); err != nil {
+		return nil, err
+	}
+	return iss, nil
+}
+
+func (iss *issuer) reload() error {
+	info, err := os.Stat(iss.listPath)
+	if err != nil {
+		return fmt.Errorf("ocspresponder: stat %s: %w", iss.listPath, err)
+	}
+	entries, err := parseIndex(iss.listPath)
+	if err != nil {
+		return err
+	}
+	iss.mu.Lock()
+	iss.entries = entries
+	iss.listModTime = info.ModTime()
+	iss.mu.Unlock()
+	return nil
+}
+
+func (iss *issuer) maybeReload(log Logger) {
+	info, err := os.Stat(iss.listPath)
+	if err != nil {
+		log.Errorf("ocspresponder: unable to stat %s: %s", iss.listPath, err)
+		return
+	}
+	iss.mu.RLock()
+	stale := info.ModTime().After(iss.listModTime)
+	iss.mu.RUnlock()
+	if !stale {
+		return
+	}
+	if err := iss.reload(); err != nil {
+		log.Errorf("ocspresponder: reload of %s failed: %s", iss.listPath, err)
+		return
+	}
+	log.Noticef("ocspresponder: reloaded certificate list %s", iss.listPath)
+}
+
+// Start begins serving OCSP over HTTP on cfg.Addr and begins watching every
+// issuer's CertificateList for changes.
+func (r *Responder) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", r.handle)
+	r.srv = &http.Server{Addr: r.cfg.Addr, Handler: mux}
+
+	go r.watchForReload()
+
+	ln, err := net.Listen("tcp", r.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("ocspresponder: listen on %s: %w", r.cfg.Addr, err)
+	}
+	r.ln = ln
+	go r.srv.Serve(ln)
+	return nil
+}
+
+// Addr returns the address the HTTP listener is bound to, useful when Start
+// was configured with a ":0" port.
+func (r *Responder) Addr() string {
+	return r.ln.Addr().String()
+}
+
+// Shutdown stops the HTTP listener and the reload watcher.
+func (r *Responder) Shutdown(ctx context.Context) error {
+	close(r.shutdown)
+	if r.srv != nil {
+		return r.srv.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (r *Responder) watchForReload() {
+	t := time.NewTicker(r.cfg.ReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		case <-t.C:
+			for _, iss := range r.issuers {
+				iss.maybeReload(r.log)
+			}
+		}
+	}
+}
+
+func (r *Responder) handle(w http.ResponseWriter, req *http.Request) {
+	var reqData []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		// RFC 6960 Appendix A.1.1 requires the client to URL-encode the
+		// base64 request before placing it in the path (it can contain '+',
+		// '/' and '='), so unescape explicitly before base64-decoding
+		// rather than relying on req.URL.Path already being unescaped.
+		path, unescapeErr := url.PathUnescape(req.URL.EscapedPath())
+		if unescapeErr != nil {
+			http.Error(w, unescapeErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(path) > 0 && path[0] == '/' {
+			path = path[1:]
+		}
+		reqData, err = base64.StdEncoding.DecodeString(path)
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		defer req.Body.Close()
+		reqData, err = io.ReadAll(req.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ocspReq, err := ocsp.ParseRequest(reqData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	iss := r.issuerFor(ocspReq.IssuerKeyHash)
+	if iss == nil {
+		http.Error(w, "unknown issuer", http.StatusNotFound)
+		return
+	}
+
+	respData, err := iss.sign(ocspReq.SerialNumber, r.cfg.ValidityWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(respData)
+}
+
+func (r *Responder) issuerFor(keyHash []byte) *issuer {
+	return r.issuers[hex.EncodeToString(keyHash)]
+}
+
+func (iss *issuer) sign(serial *big.Int, validity time.Duration) ([]byte, error) {
+	status := ocsp.Unknown
+	var revokedAt time.Time
+
+	iss.mu.RLock()
+	entry, ok := iss.entries[keyForSerial(serial)]
+	iss.mu.RUnlock()
+	if ok {
+		switch entry.state {
+		case 'V':
+			status = ocsp.Good
+		case 'R':
+			status = ocsp.Revoked
+			revokedAt = entry.revocationTime
+		case 'E':
+			status = ocsp.Unknown
+		}
+	}
+
+	now := time.Now()
+	tmpl := ocsp.Response{
+		Status:       status,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(validity),
+	}
+	if status == ocsp.Revoked {
+		tmpl.RevokedAt = revokedAt
+	}
+
+	return ocsp.CreateResponse(iss.cert, iss.responderCert, tmpl, iss.responderKey)
+}
+
+// subjectPublicKeyInfo mirrors the ASN.1 structure so we can get at the raw
+// bit string backing the issuer's public key.
+type subjectPublicKeyInfo struct {
+	Raw       asn1.RawContent
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// issuerKeyHash computes the SHA-1 hash of the issuer's public key bits, as
+// used in the IssuerKeyHash field of an OCSP request/response (RFC 6960
+// 4.1.1).
+func issuerKeyHash(cert *x509.Certificate) []byte {
+	var info subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &info); err != nil {
+		// Should be unreachable: cert was already parsed successfully by
+		// x509.ParseCertificate, which validates this same structure.
+		panic(fmt.Sprintf("ocspresponder: unexpected SubjectPublicKeyInfo: %s", err))
+	}
+	h := sha1.Sum(info.PublicKey.RightAlign())
+	return h[:]
+}
+
+func readCertPEM(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocspresponder
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// genTestCA writes a self-signed CA certificate/key pair to PEM files under
+// t.TempDir and returns the paths, along with the parsed certificate and its
+// OCSP issuer key hash.
+func genTestCA(t *testing.T, cn string) (certPath, keyPath string, cert *x509.Certificate, keyHash []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath = filepath.Join(dir, cn+"-cert.pem")
+	keyPath = filepath.Join(dir, cn+"-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+	return certPath, keyPath, cert, issuerKeyHash(cert)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeIndexFor writes a single-entry index.txt for cert in the given state.
+func writeIndexFor(t *testing.T, path string, cert *x509.Certificate, state byte) {
+	t.Helper()
+	contents := string(state) + "\t991231235959Z\t\t" + hex.EncodeToString(cert.SerialNumber.Bytes()) + "\tunknown\t" + cert.Subject.String() + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssuerForDispatchesByKeyHash(t *testing.T) {
+	_, _, caA, hashA := genTestCA(t, "issuer-a")
+	_, _, _, hashB := genTestCA(t, "issuer-b")
+
+	r := &Responder{issuers: map[string]*issuer{
+		hex.EncodeToString(hashA): {cert: caA},
+	}}
+
+	if got := r.issuerFor(hashA); got == nil || got.cert != caA {
+		t.Fatalf("expected issuerFor to find the registered issuer for hashA, got %v", got)
+	}
+	if got := r.issuerFor(hashB); got != nil {
+		t.Fatalf("expected issuerFor to return nil for an unregistered issuer, got %v", got)
+	}
+}
+
+func TestSignHonorsIndexState(t *testing.T) {
+	caCertPath, caKeyPath, caCert, _ := genTestCA(t, "sign-test-ca")
+	indexPath := filepath.Join(t.TempDir(), "index.txt")
+
+	leafSerial := big.NewInt(42)
+	writeIndexFor(t, indexPath, &x509.Certificate{SerialNumber: leafSerial, Subject: pkix.Name{CommonName: "leaf"}}, 'R')
+
+	iss, err := loadIssuer(IssuerConfig{
+		CACertificate:        caCertPath,
+		ResponderCertificate: caCertPath,
+		ResponderKey:         caKeyPath,
+		CertificateList:      indexPath,
+	})
+	if err != nil {
+		t.Fatalf("loadIssuer: %s", err)
+	}
+
+	raw, err := iss.sign(leafSerial, time.Hour)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	resp, err := ocsp.ParseResponse(raw, caCert)
+	if err != nil {
+		t.Fatalf("ParseResponse: %s", err)
+	}
+	if resp.Status != ocsp.Revoked {
+		t.Fatalf("expected Revoked for a serial marked 'R' in the index, got %d", resp.Status)
+	}
+
+	// A serial absent from the index is reported Unknown rather than Good.
+	raw, err = iss.sign(big.NewInt(999), time.Hour)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	resp, err = ocsp.ParseResponse(raw, caCert)
+	if err != nil {
+		t.Fatalf("ParseResponse: %s", err)
+	}
+	if resp.Status != ocsp.Unknown {
+		t.Fatalf("expected Unknown for a serial absent from the index, got %d", resp.Status)
+	}
+}
+
+func TestMaybeReloadPicksUpIndexChanges(t *testing.T) {
+	caCertPath, caKeyPath, _, _ := genTestCA(t, "reload-test-ca")
+	indexPath := filepath.Join(t.TempDir(), "index.txt")
+
+	serial := big.NewInt(7)
+	writeIndexFor(t, indexPath, &x509.Certificate{SerialNumber: serial, Subject: pkix.Name{CommonName: "leaf"}}, 'V')
+
+	iss, err := loadIssuer(IssuerConfig{
+		CACertificate:        caCertPath,
+		ResponderCertificate: caCertPath,
+		ResponderKey:         caKeyPath,
+		CertificateList:      indexPath,
+	})
+	if err != nil {
+		t.Fatalf("loadIssuer: %s", err)
+	}
+
+	iss.mu.RLock()
+	before := iss.entries[keyForSerial(serial)].state
+	iss.mu.RUnlock()
+	if before != 'V' {
+		t.Fatalf("expected initial state 'V', got %q", before)
+	}
+
+	writeIndexFor(t, indexPath, &x509.Certificate{SerialNumber: serial, Subject: pkix.Name{CommonName: "leaf"}}, 'R')
+	// Force the mtime forward: some filesystems have coarse enough mtime
+	// resolution that a rewrite within the same tick wouldn't otherwise
+	// look "stale" to maybeReload.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(indexPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	iss.maybeReload(stdLogger{})
+
+	iss.mu.RLock()
+	after := iss.entries[keyForSerial(serial)].state
+	iss.mu.RUnlock()
+	if after != 'R' {
+		t.Fatalf("expected maybeReload to pick up the updated state 'R', got %q", after)
+	}
+}
+
+// TestHandleGETRequiresURLEncodedRequest proves handle's GET path decodes a
+// properly URL-encoded base64 OCSP request (RFC 6960 Appendix A.1.1), rather
+// than only tolerating raw, un-encoded base64 the way a naive client/server
+// pair happens to round-trip.
+func TestHandleGETRequiresURLEncodedRequest(t *testing.T) {
+	caCertPath, caKeyPath, caCert, hash := genTestCA(t, "handle-get-ca")
+	indexPath := filepath.Join(t.TempDir(), "index.txt")
+	// The request below is built against caCert itself (there's no separate
+	// leaf certificate handy here), so the index needs an entry for its
+	// serial, not an arbitrary one.
+	writeIndexFor(t, indexPath, caCert, 'V')
+
+	iss, err := loadIssuer(IssuerConfig{
+		CACertificate:        caCertPath,
+		ResponderCertificate: caCertPath,
+		ResponderKey:         caKeyPath,
+		CertificateList:      indexPath,
+	})
+	if err != nil {
+		t.Fatalf("loadIssuer: %s", err)
+	}
+	r := &Responder{
+		cfg:     Config{ValidityWindow: time.Hour},
+		log:     stdLogger{},
+		issuers: map[string]*issuer{hex.EncodeToString(hash): iss},
+	}
+
+	ocspReq, err := ocsp.CreateRequest(caCert, caCert, nil)
+	if err != nil {
+		t.Fatalf("CreateRequest: %s", err)
+	}
+	b64 := base64.StdEncoding.EncodeToString(ocspReq)
+	if !bytesContainAny(b64, "+/=") {
+		t.Skip("generated request's base64 happens to contain none of +/=; cannot exercise encoding")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/"+url.QueryEscape(b64), nil)
+	r.handle(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a properly URL-encoded GET request, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp, err := ocsp.ParseResponse(rec.Body.Bytes(), caCert)
+	if err != nil {
+		t.Fatalf("ParseResponse: %s", err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Fatalf("expected Good, got %d", resp.Status)
+	}
+}
+
+func bytesContainAny(s, chars string) bool {
+	for _, c := range chars {
+		for _, sc := range s {
+			if sc == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestMaybeReloadSkipsWhenUnchanged(t *testing.T) {
+	caCertPath, caKeyPath, _, _ := genTestCA(t, "reload-unchanged-ca")
+	indexPath := filepath.Join(t.TempDir(), "index.txt")
+	serial := big.NewInt(9)
+	writeIndexFor(t, indexPath, &x509.Certificate{SerialNumber: serial, Subject: pkix.Name{CommonName: "leaf"}}, 'V')
+
+	iss, err := loadIssuer(IssuerConfig{
+		CACertificate:        caCertPath,
+		ResponderCertificate: caCertPath,
+		ResponderKey:         caKeyPath,
+		CertificateList:      indexPath,
+	})
+	if err != nil {
+		t.Fatalf("loadIssuer: %s", err)
+	}
+
+	iss.mu.RLock()
+	modTimeBefore := iss.listModTime
+	iss.mu.RUnlock()
+
+	iss.maybeReload(stdLogger{})
+
+	iss.mu.RLock()
+	modTimeAfter := iss.listModTime
+	iss.mu.RUnlock()
+	if !modTimeAfter.Equal(modTimeBefore) {
+		t.Fatal("expected maybeReload to be a no-op when the index file's mtime hasn't advanced")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+)
+
+// TLSConfigOpts holds the parsed TLS config information for a listener,
+// along with any extra knobs (e.g. OCSP) that affect how the resulting
+// tls.Config is generated.
+type TLSConfigOpts struct {
+	CertFile          string
+	KeyFile           string
+	CaFile            string
+	Verify            bool
+	Insecure          bool
+	Map               bool
+	TLSCheckKnownURLs bool
+	Timeout           float64
+	Ciphers           []uint16
+	CurvePreferences  []tls.CurveID
+	PinnedCerts       map[string]struct{}
+
+	// OCSPMode dictates whether/how the server fetches, caches and staples
+	// an OCSP response for this certificate. See OCSPMode for the possible
+	// values and their semantics.
+	OCSPMode OCSPMode
+
+	// OCSPStatusDir is the directory under which raw OCSP responses are
+	// persisted, keyed by certificate serial number, so a staple can be
+	// reused across restarts without an extra round trip to the responder.
+	OCSPStatusDir string
+
+	// OCSPServerOverride, when non-empty, replaces the list of responder
+	// URLs found in the leaf certificate's Authority Information Access
+	// extension. For the server's own staple only the "http" source uses
+	// it; GenOCSPConfig also hands it to OCSPPeerVerifier, which queries
+	// these URLs instead of a peer certificate's own.
+	OCSPServerOverride []string
+
+	// OCSPSourceType selects the OCSPSource used to obtain a staple for this
+	// certificate: "http" (the default, querying OCSPServerOverride or the
+	// certificate's responder URL), "file", "dir", or any name registered
+	// via RegisterOCSPSource. Corresponds to the `source` field of an
+	// `ocsp { ... }` config block; see ApplyOCSPConfigBlock.
+	OCSPSourceType string
+
+	// OCSPSourceConfig is the raw remainder of the `ocsp { ... }` config
+	// block, passed to the named source's constructor (e.g. `path` for
+	// "file"/"dir"); see ApplyOCSPConfigBlock.
+	OCSPSourceConfig json.RawMessage
+
+	// OCSPEnv, when set, is the OCSPEnv GenOCSPConfig uses for logging, the
+	// /ocspz status registry and the peer verification cache, instead of
+	// creating a private one. Set this to the same OCSPEnv across every
+	// TLSConfigOpts a single server builds so its listeners share one view
+	// of OCSP state; leave nil (e.g. in standalone tests) to get an
+	// independent OCSPEnv per call.
+	OCSPEnv *OCSPEnv
+}
+
+// ParseOCSPMode maps the `mode` value of an `ocsp { ... }` config block
+// ("never", "auto", "always", "must", "always+must") to an OCSPMode. This is
+// the piece a config-file parser's `ocsp` block handler would call to fill
+// in TLSConfigOpts.OCSPMode; this source tree has no top-level `.conf`
+// parser of its own yet to call it from, so for now it's exercised directly
+// by Go callers that already have the mode as a string (e.g. read from some
+// other configuration format) and by tests.
+func ParseOCSPMode(mode string) (OCSPMode, error) {
+	switch mode {
+	case "never":
+		return OCSPModeNever, nil
+	case "auto":
+		return OCSPModeAuto, nil
+	case "always":
+		return OCSPModeAlways, nil
+	case "must":
+		return OCSPModeMust, nil
+	case "always+must":
+		return OCSPModeAlwaysMust, nil
+	default:
+		return OCSPModeNever, fmt.Errorf("ocsp: unknown mode %q", mode)
+	}
+}
+
+// ApplyOCSPConfigBlock fills in t's OCSP fields from the already-decoded
+// body of an `ocsp { ... }` config block:
+//
+//	ocsp {
+//	    mode: "must"
+//	    source: "file"
+//	    path: "/var/run/nats/ocsp-cache"
+//	}
+//
+// mode may be empty, in which case t.OCSPMode is left unchanged. source and
+// rest (the remaining fields of the block, re-marshaled by the caller) map
+// directly onto OCSPSourceType/OCSPSourceConfig; see RegisterOCSPSource for
+// what each source name expects there. Like ParseOCSPMode, this is the
+// integration point a real `.conf` parser would call once it has decoded an
+// `ocsp` block — this source tree doesn't have one yet.
+func ApplyOCSPConfigBlock(t *TLSConfigOpts, mode, source string, rest json.RawMessage) error {
+	if mode != "" {
+		m, err := ParseOCSPMode(mode)
+		if err != nil {
+			return err
+		}
+		t.OCSPMode = m
+	}
+	t.OCSPSourceType = source
+	t.OCSPSourceConfig = rest
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestParseOCSPMode(t *testing.T) {
+	cases := map[string]OCSPMode{
+		"never":       OCSPModeNever,
+		"auto":        OCSPModeAuto,
+		"always":      OCSPModeAlways,
+		"must":        OCSPModeMust,
+		"always+must": OCSPModeAlwaysMust,
+	}
+	for in, want := range cases {
+		got, err := ParseOCSPMode(in)
+		if err != nil {
+			t.Fatalf("ParseOCSPMode(%q): unexpected error: %s", in, err)
+		}
+		if got != want {
+			t.Fatalf("ParseOCSPMode(%q) = %v, want %v", in, got, want)
+		}
+	}
+	if _, err := ParseOCSPMode("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestApplyOCSPConfigBlock(t *testing.T) {
+	var t1 TLSConfigOpts
+	rest := []byte(`{"path":"/var/run/nats/ocsp-cache"}`)
+	if err := ApplyOCSPConfigBlock(&t1, "must", "file", rest); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if t1.OCSPMode != OCSPModeMust {
+		t.Fatalf("expected OCSPMode Must, got %v", t1.OCSPMode)
+	}
+	if t1.OCSPSourceType != "file" {
+		t.Fatalf("expected OCSPSourceType \"file\", got %q", t1.OCSPSourceType)
+	}
+	if string(t1.OCSPSourceConfig) != string(rest) {
+		t.Fatalf("expected OCSPSourceConfig %s, got %s", rest, t1.OCSPSourceConfig)
+	}
+
+	// An empty mode leaves any previously set OCSPMode untouched.
+	t2 := TLSConfigOpts{OCSPMode: OCSPModeAlways}
+	if err := ApplyOCSPConfigBlock(&t2, "", "http", nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if t2.OCSPMode != OCSPModeAlways {
+		t.Fatalf("expected OCSPMode to remain Always, got %v", t2.OCSPMode)
+	}
+
+	if err := ApplyOCSPConfigBlock(&t1, "bogus", "http", nil); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"golang.org/x/crypto/ocsp"
+)
+
+// TestOCSPPeerVerifierDropsRevokedPeer proves OCSPPeerVerifier is a real,
+// working tls.Config.VerifyConnection callback: it drives an actual TLS
+// handshake between two in-memory-generated certificates and asserts the
+// connection is accepted or dropped according to the peer's live OCSP
+// status, for both OCSPModeAlwaysMust (strict) and OCSPModeAuto (lenient
+// on Unknown).
+func TestOCSPPeerVerifierDropsRevokedPeer(t *testing.T) {
+	caCertPEM, caKeyPEM, caCert, caKey := genSelfSignedCA(t)
+
+	ocspr := newOCSPResponder(t, caCertPEM, caKeyPEM)
+	defer ocspr.Close()
+
+	serverCert := genLeaf(t, "peer-verifier-server", caCert, caKey, []string{ocspr.URL})
+	// The client side runs the same verifier against the server's
+	// certificate, so it must be Good for the accept cases to hold.
+	setOCSPStatus(t, ocspr.URL, serverCert.certPEMPath, ocsp.Good)
+
+	cases := []struct {
+		name      string
+		status    int
+		mode      server.OCSPMode
+		expectErr bool
+	}{
+		{"good peer is accepted", ocsp.Good, server.OCSPModeAlwaysMust, false},
+		{"revoked peer is dropped", ocsp.Revoked, server.OCSPModeAlwaysMust, true},
+		{"unknown peer is dropped under AlwaysMust", ocsp.Unknown, server.OCSPModeAlwaysMust, true},
+		{"unknown peer is accepted under Auto", ocsp.Unknown, server.OCSPModeAuto, false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Each case gets its own client certificate (distinct serial)
+			// so the peer verifier's in-memory cache can't leak a status
+			// set by an earlier case.
+			clientCert := genLeaf(t, "peer-verifier-client-"+c.name, caCert, caKey, []string{ocspr.URL})
+			setOCSPStatus(t, ocspr.URL, clientCert.certPEMPath, c.status)
+
+			verifier := server.OCSPPeerVerifier(c.mode, []string{ocspr.URL}, server.NewOCSPEnv())
+
+			srvTLS := &tls.Config{
+				Certificates:     []tls.Certificate{serverCert.pair},
+				ClientAuth:       tls.RequireAnyClientCert,
+				VerifyConnection: verifier,
+				MinVersion:       tls.VersionTLS12,
+			}
+			cliTLS := &tls.Config{
+				Certificates:       []tls.Certificate{clientCert.pair},
+				InsecureSkipVerify: true,
+				VerifyConnection:   verifier,
+				MinVersion:         tls.VersionTLS12,
+			}
+
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", srvTLS)
+			if err != nil {
+				t.Fatalf("failed to listen: %s", err)
+			}
+			defer ln.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				defer conn.Close()
+				errCh <- conn.(*tls.Conn).Handshake()
+			}()
+
+			dialConn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", ln.Addr().String(), cliTLS)
+			var handshakeErr error
+			if err != nil {
+				handshakeErr = err
+			} else {
+				defer dialConn.Close()
+			}
+
+			select {
+			case serverErr := <-errCh:
+				if handshakeErr == nil {
+					handshakeErr = serverErr
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for server-side handshake result")
+			}
+
+			if c.expectErr && handshakeErr == nil {
+				t.Fatalf("expected handshake to fail for status %d under mode %v, it succeeded", c.status, c.mode)
+			}
+			if !c.expectErr && handshakeErr != nil {
+				t.Fatalf("expected handshake to succeed for status %d under mode %v, got: %s", c.status, c.mode, handshakeErr)
+			}
+		})
+	}
+}
+
+type genCert struct {
+	pair        tls.Certificate
+	certPEMPath string
+}
+
+// genSelfSignedCA creates a self-signed CA, writes its cert and key out as
+// PEM files (so it can be handed to the existing newOCSPResponder/
+// parseCertPEM helpers), and returns both the PEM paths and the parsed
+// cert/key.
+func genSelfSignedCA(t *testing.T) (certPEMPath, keyPEMPath string, cert *x509.Certificate, key *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ocsp-peer-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEMPath = writePEMTemp(t, "ca-cert-*.pem", "CERTIFICATE", der)
+	keyPEMPath = writePEMTemp(t, "ca-key-*.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return certPEMPath, keyPEMPath, cert, key
+}
+
+// genLeaf creates a leaf certificate signed by ca/caKey, carrying
+// ocspServers as its Authority Information Access OCSP responder list.
+func genLeaf(t *testing.T, cn string, ca *x509.Certificate, caKey *rsa.PrivateKey, ocspServers []string) genCert {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		OCSPServer:   ocspServers,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := writePEMTemp(t, "leaf-cert-*.pem", "CERTIFICATE", der)
+
+	// The chain includes the CA so that the TLS peer presents an issuer
+	// alongside its leaf: OCSPPeerVerifier needs cs.PeerCertificates[1] to
+	// validate the OCSP response signature.
+	pair := tls.Certificate{
+		Certificate: [][]byte{der, ca.Raw},
+		PrivateKey:  key,
+	}
+	return genCert{pair: pair, certPEMPath: certPath}
+}
+
+func writePEMTemp(t *testing.T, pattern, blockType string, der []byte) string {
+	t.Helper()
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
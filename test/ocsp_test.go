@@ -55,6 +55,7 @@ func TestOCSP(t *testing.T) {
 	doLog = true
 	s := RunServer(&opts)
 	defer s.Shutdown()
+	defer opts.OCSPConfig.Stop()
 	defer removeDir(t, opts.OCSPConfig.StatusDir)
 
 	go func() {
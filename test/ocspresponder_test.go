@@ -0,0 +1,117 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/ocspresponder"
+	"golang.org/x/crypto/ocsp"
+)
+
+// TestOCSPResponderEmbedded exercises the embedded responder end to end
+// against the same CA material TestOCSP uses, proving out a single-issuer
+// configuration driven from an index.txt certificate list.
+func TestOCSPResponderEmbedded(t *testing.T) {
+	const (
+		caCert     = "configs/certs/ocsp/ca-cert.pem"
+		caKey      = "configs/certs/ocsp/ca-key.pem"
+		serverCert = "configs/certs/ocsp/server-cert.pem"
+	)
+
+	indexPath := createIndex(t, serverCert, 'V')
+	defer os.Remove(indexPath)
+
+	r, err := ocspresponder.New(ocspresponder.Config{
+		Issuers: []ocspresponder.IssuerConfig{
+			{
+				CACertificate:        caCert,
+				ResponderCertificate: caCert,
+				ResponderKey:         caKey,
+				CertificateList:      indexPath,
+			},
+		},
+		Addr:           "127.0.0.1:0",
+		ValidityWindow: 4 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create embedded responder: %s", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("failed to start embedded responder: %s", err)
+	}
+	defer r.Shutdown(context.Background())
+
+	cert := parseCertPEM(t, serverCert)
+	issuer := parseCertPEM(t, caCert)
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Fatalf("failed to create OCSP request: %s", err)
+	}
+
+	resp := postOCSPRequest(t, r.Addr(), req)
+	parsed, err := ocsp.ParseResponse(resp, issuer)
+	if err != nil {
+		t.Fatalf("failed to parse OCSP response: %s", err)
+	}
+	if parsed.Status != ocsp.Good {
+		t.Fatalf("expected status Good, got %d", parsed.Status)
+	}
+}
+
+// postOCSPRequest POSTs an OCSP request to addr and returns the raw DER
+// response body.
+func postOCSPRequest(t *testing.T, addr string, req []byte) []byte {
+	t.Helper()
+	hc := &http.Client{Timeout: 3 * time.Second}
+	resp, err := hc.Post(fmt.Sprintf("http://%s/", addr), "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected responder status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// createIndex writes a single-entry OpenSSL index.txt for certPEM with the
+// given state ('V' or 'R') and returns its path.
+func createIndex(t *testing.T, certPEM string, state byte) string {
+	t.Helper()
+	cert := parseCertPEM(t, certPEM)
+
+	f, err := os.CreateTemp("", "ocsp-index-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := fmt.Sprintf("%c\t%s\t\t%X\tunknown\t%s\n", state, "991231235959Z", cert.SerialNumber, cert.Subject.String())
+	if _, err := f.WriteString(line); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}